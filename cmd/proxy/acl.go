@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// peerACL is the configured allow-list of tailnet identities permitted to
+// use this proxy, checked via LocalClient.WhoIs against each accepted
+// connection's remote address. A peerACL with no users or tags allows
+// every tailnet peer.
+type peerACL struct {
+	users map[string]bool
+	tags  map[string]bool
+}
+
+func newPeerACL(allowUsers, allowTags string) peerACL {
+	return peerACL{users: toSet(allowUsers), tags: toSet(allowTags)}
+}
+
+func toSet(csv string) map[string]bool {
+	set := make(map[string]bool)
+	for _, v := range strings.Split(csv, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			set[v] = true
+		}
+	}
+	return set
+}
+
+func (a peerACL) enabled() bool {
+	return len(a.users) > 0 || len(a.tags) > 0
+}
+
+// authorize reports whether who is permitted by a, and an identity string
+// (login name, or node tags if the peer is a tagged node) for logging.
+func authorize(a peerACL, who *apitype.WhoIsResponse) (identity string, ok bool) {
+	var tags []string
+	if who.Node != nil {
+		tags = who.Node.Tags
+	}
+	if who.UserProfile != nil && who.UserProfile.LoginName != "" {
+		identity = who.UserProfile.LoginName
+	} else if len(tags) > 0 {
+		identity = strings.Join(tags, ",")
+	}
+
+	if !a.enabled() {
+		return identity, true
+	}
+	if identity != "" && a.users[identity] {
+		return identity, true
+	}
+	for _, t := range tags {
+		if a.tags[t] {
+			return identity, true
+		}
+	}
+	return identity, false
+}
+
+// identifiedConn carries the tailnet identity an authorizingListener
+// resolved for a connection, so serveSOCKS5 can include it in the
+// session's log record.
+type identifiedConn struct {
+	net.Conn
+	identity string
+}
+
+// authorizingListener rejects connections whose tailnet identity isn't in
+// acl, resolved with lc.WhoIs. It's only meaningful for connections that
+// actually arrive over the tailnet (egress mode); main leaves it disabled
+// in ingress mode, where accepted connections are local, non-tailnet
+// processes.
+type authorizingListener struct {
+	net.Listener
+	ctx    context.Context
+	lc     *tailscale.LocalClient
+	acl    peerACL
+	active bool
+}
+
+func (l authorizingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || !l.active {
+			return conn, err
+		}
+
+		who, whoErr := l.lc.WhoIs(l.ctx, conn.RemoteAddr().String())
+		identity, ok := "", !l.acl.enabled()
+		if whoErr == nil {
+			identity, ok = authorize(l.acl, who)
+		}
+
+		if l.acl.enabled() && !ok {
+			slog.Info("peer not in allow-list, rejecting connection", "remote", conn.RemoteAddr(), "identity", identity, "whois_error", whoErr)
+			conn.Close()
+			proxyMetrics.rejected.Add(1)
+			continue
+		}
+		return identifiedConn{Conn: conn, identity: identity}, nil
+	}
+}
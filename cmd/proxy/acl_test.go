@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func whoIs(login string, tags ...string) *apitype.WhoIsResponse {
+	who := &apitype.WhoIsResponse{}
+	if login != "" {
+		who.UserProfile = &tailcfg.UserProfile{LoginName: login}
+	}
+	if len(tags) > 0 {
+		who.Node = &tailcfg.Node{Tags: tags}
+	}
+	return who
+}
+
+func TestAuthorizeDisabledAllowsEveryone(t *testing.T) {
+	a := newPeerACL("", "")
+	identity, ok := authorize(a, whoIs("alice@example.com"))
+	if !ok {
+		t.Error("an ACL with no users/tags configured should allow every peer")
+	}
+	if identity != "alice@example.com" {
+		t.Errorf("identity = %q, want alice@example.com", identity)
+	}
+}
+
+func TestAuthorizeByUser(t *testing.T) {
+	a := newPeerACL("alice@example.com", "")
+	if _, ok := authorize(a, whoIs("alice@example.com")); !ok {
+		t.Error("alice@example.com should be allowed")
+	}
+	if _, ok := authorize(a, whoIs("bob@example.com")); ok {
+		t.Error("bob@example.com should be denied")
+	}
+}
+
+func TestAuthorizeByTag(t *testing.T) {
+	a := newPeerACL("", "tag:ci")
+	if _, ok := authorize(a, whoIs("", "tag:ci")); !ok {
+		t.Error("a peer tagged tag:ci should be allowed")
+	}
+	if _, ok := authorize(a, whoIs("", "tag:prod")); ok {
+		t.Error("a peer without an allowed tag should be denied")
+	}
+}
+
+func TestAuthorizeIdentityForLogging(t *testing.T) {
+	a := newPeerACL("", "")
+	identity, _ := authorize(a, whoIs("", "tag:ci", "tag:dev"))
+	if identity != "tag:ci,tag:dev" {
+		t.Errorf("identity = %q, want the joined tag list for a tagged node with no user profile", identity)
+	}
+}
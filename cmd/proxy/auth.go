@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// aclResolveTimeout bounds how long resolveForACL will wait for a DNS
+// lookup, so a slow or unresponsive resolver can't hang a CONNECT
+// request's goroutine indefinitely.
+const aclResolveTimeout = 3 * time.Second
+
+// User describes one SOCKS5 credential and the destinations it may reach.
+//
+// AllowCIDRs/AllowSuffixes are an allow-list: if either is non-empty, a
+// destination must match at least one entry to be permitted. DenyCIDRs/
+// DenySuffixes are checked first and always win over the allow-list.
+type User struct {
+	Username      string   `json:"username"`
+	PasswordHash  string   `json:"password_hash"`
+	AllowCIDRs    []string `json:"allow_cidrs,omitempty"`
+	AllowSuffixes []string `json:"allow_suffixes,omitempty"`
+	DenyCIDRs     []string `json:"deny_cidrs,omitempty"`
+	DenySuffixes  []string `json:"deny_suffixes,omitempty"`
+
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+}
+
+// UserStore maps username to *User. A nil or empty UserStore means
+// authentication is disabled and the server only offers "no auth".
+type UserStore map[string]*User
+
+// loadUsersFile reads a JSON array of Users from path.
+func loadUsersFile(path string) (UserStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open users file: %w", err)
+	}
+	defer f.Close()
+
+	var users []*User
+	if err := json.NewDecoder(bufio.NewReader(f)).Decode(&users); err != nil {
+		return nil, fmt.Errorf("parse users file %s: %w", path, err)
+	}
+
+	store := make(UserStore, len(users))
+	for _, u := range users {
+		if err := u.compileNets(); err != nil {
+			return nil, fmt.Errorf("user %q: %w", u.Username, err)
+		}
+		store[u.Username] = u
+	}
+	return store, nil
+}
+
+// parseUsersEnv parses the compact "alice:hash,bob:hash" form used by the
+// SOCKS_USERS env var. This form carries no per-user access control; use
+// -users-file for that.
+func parseUsersEnv(s string) (UserStore, error) {
+	store := make(UserStore)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid SOCKS_USERS entry %q, want user:bcrypt-hash", pair)
+		}
+		store[parts[0]] = &User{Username: parts[0], PasswordHash: parts[1]}
+	}
+	return store, nil
+}
+
+func (u *User) compileNets() error {
+	var err error
+	if u.allowNets, err = parseCIDRs(u.AllowCIDRs); err != nil {
+		return err
+	}
+	if u.denyNets, err = parseCIDRs(u.DenyCIDRs); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", c, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// authenticate looks up username in store and checks password against the
+// stored bcrypt hash.
+func authenticate(store UserStore, username, password string) (*User, bool) {
+	u, ok := store[username]
+	if !ok {
+		return nil, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return nil, false
+	}
+	return u, true
+}
+
+// Authorized reports whether u may connect to host (a bare hostname or IP,
+// no port), given the IPs host resolves to (resolvedIPs is ignored if host
+// is itself a literal IP). Callers must resolve domain names before
+// calling this so CIDR rules see the real destination instead of being
+// silently inert for every non-IP request — see resolveForACL. A user with
+// no allow/deny lists may reach anything.
+func (u *User) Authorized(host string, resolvedIPs []net.IP) bool {
+	ips := resolvedIPs
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	}
+
+	for _, n := range u.denyNets {
+		for _, ip := range ips {
+			if n.Contains(ip) {
+				return false
+			}
+		}
+	}
+	for _, suffix := range u.DenySuffixes {
+		if hasDomainSuffix(host, suffix) {
+			return false
+		}
+	}
+
+	if len(u.allowNets) == 0 && len(u.AllowSuffixes) == 0 {
+		return true
+	}
+	for _, n := range u.allowNets {
+		for _, ip := range ips {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, suffix := range u.AllowSuffixes {
+		if hasDomainSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCIDRRules reports whether u has any AllowCIDRs/DenyCIDRs configured,
+// i.e. whether resolving a domain name before calling Authorized could
+// actually change its answer. Suffix-only users don't need the lookup.
+func (u *User) hasCIDRRules() bool {
+	return len(u.allowNets) > 0 || len(u.denyNets) > 0
+}
+
+// resolveForACL resolves host to the IP addresses Authorized should check
+// CIDR rules against. It returns nil if host is already a literal IP (the
+// caller doesn't need it) or if resolution fails or times out, in which
+// case Authorized falls back to suffix-only rules and the dial that
+// follows will surface the same lookup failure. Callers should only call
+// this when the user actually has CIDR rules configured (see
+// hasCIDRRules) — it's a DNS lookup on the hot path of every CONNECT
+// request otherwise unused.
+func resolveForACL(host string) []net.IP {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), aclResolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips
+}
+
+// containsMethod reports whether method appears in the client's offered
+// SOCKS5 auth methods.
+func containsMethod(methods []byte, method byte) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateUserPass performs the RFC 1929 username/password subnegotiation
+// and authenticates the result against store.
+//
+// +-----+------+----------+------+----------+
+// | VER | ULEN | UNAME    | PLEN | PASSWD   |
+// +-----+------+----------+------+----------+
+func negotiateUserPass(client io.ReadWriter, buf []byte, store UserStore) (*User, bool) {
+	if _, err := io.ReadFull(client, buf[:2]); err != nil {
+		return nil, false
+	}
+	if buf[0] != 1 { // subnegotiation version
+		return nil, false
+	}
+	ulen := int(buf[1])
+	uname := make([]byte, ulen)
+	if _, err := io.ReadFull(client, uname); err != nil {
+		return nil, false
+	}
+
+	if _, err := io.ReadFull(client, buf[:1]); err != nil {
+		return nil, false
+	}
+	plen := int(buf[0])
+	passwd := make([]byte, plen)
+	if _, err := io.ReadFull(client, passwd); err != nil {
+		return nil, false
+	}
+
+	u, ok := authenticate(store, string(uname), string(passwd))
+	if !ok {
+		client.Write([]byte{1, 1}) //nolint:errcheck // 1 = failure
+		return nil, false
+	}
+	if _, err := client.Write([]byte{1, 0}); err != nil { // 0 = success
+		return nil, false
+	}
+	return u, true
+}
+
+// hasDomainSuffix reports whether host is suffix or a subdomain of it.
+func hasDomainSuffix(host, suffix string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	suffix = strings.TrimSuffix(strings.ToLower(suffix), ".")
+	return host == suffix || strings.HasSuffix(host, "."+suffix)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func mustUser(t *testing.T, u *User) *User {
+	t.Helper()
+	if err := u.compileNets(); err != nil {
+		t.Fatalf("compileNets: %v", err)
+	}
+	return u
+}
+
+func TestAuthorizedNoRules(t *testing.T) {
+	u := mustUser(t, &User{Username: "alice"})
+	if !u.Authorized("example.com", nil) {
+		t.Error("user with no allow/deny lists should reach anything")
+	}
+	if !u.Authorized("10.0.0.1", nil) {
+		t.Error("user with no allow/deny lists should reach anything")
+	}
+}
+
+func TestAuthorizedDenyCIDRLiteralIP(t *testing.T) {
+	u := mustUser(t, &User{Username: "alice", DenyCIDRs: []string{"169.254.169.254/32"}})
+	if u.Authorized("169.254.169.254", nil) {
+		t.Error("literal IP matching DenyCIDRs should be denied")
+	}
+	if !u.Authorized("1.2.3.4", nil) {
+		t.Error("literal IP outside DenyCIDRs should be allowed")
+	}
+}
+
+func TestAuthorizedDenyCIDRResolvedDomain(t *testing.T) {
+	u := mustUser(t, &User{Username: "alice", DenyCIDRs: []string{"169.254.169.254/32"}})
+	metadataIP := []net.IP{net.ParseIP("169.254.169.254")}
+	if u.Authorized("metadata.google.internal", metadataIP) {
+		t.Error("domain name resolving into a denied CIDR must be denied, not silently allowed")
+	}
+	if !u.Authorized("example.com", []net.IP{net.ParseIP("93.184.216.34")}) {
+		t.Error("domain name resolving outside DenyCIDRs should be allowed")
+	}
+}
+
+func TestAuthorizedAllowCIDR(t *testing.T) {
+	u := mustUser(t, &User{Username: "alice", AllowCIDRs: []string{"10.0.0.0/8"}})
+	if !u.Authorized("10.1.2.3", nil) {
+		t.Error("literal IP inside AllowCIDRs should be allowed")
+	}
+	if u.Authorized("8.8.8.8", nil) {
+		t.Error("literal IP outside AllowCIDRs should be denied when an allow-list is configured")
+	}
+	if u.Authorized("example.com", []net.IP{net.ParseIP("8.8.8.8")}) {
+		t.Error("domain resolving outside AllowCIDRs should be denied")
+	}
+	if !u.Authorized("internal.example.com", []net.IP{net.ParseIP("10.5.5.5")}) {
+		t.Error("domain resolving inside AllowCIDRs should be allowed")
+	}
+}
+
+func TestAuthorizedSuffixes(t *testing.T) {
+	u := mustUser(t, &User{
+		Username:      "alice",
+		AllowSuffixes: []string{"example.com"},
+		DenySuffixes:  []string{"blocked.example.com"},
+	})
+	if !u.Authorized("api.example.com", nil) {
+		t.Error("subdomain of an allowed suffix should be allowed")
+	}
+	if u.Authorized("other.com", nil) {
+		t.Error("domain outside every allow-list entry should be denied")
+	}
+	if u.Authorized("blocked.example.com", nil) {
+		t.Error("DenySuffixes must win over AllowSuffixes")
+	}
+}
+
+func TestHasDomainSuffix(t *testing.T) {
+	cases := []struct {
+		host, suffix string
+		want         bool
+	}{
+		{"example.com", "example.com", true},
+		{"api.example.com", "example.com", true},
+		{"notexample.com", "example.com", false},
+		{"EXAMPLE.COM", "example.com", true},
+		{"example.com.", "example.com", true},
+		{"example.org", "example.com", false},
+	}
+	for _, c := range cases {
+		if got := hasDomainSuffix(c.host, c.suffix); got != c.want {
+			t.Errorf("hasDomainSuffix(%q, %q) = %v, want %v", c.host, c.suffix, got, c.want)
+		}
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs([]string{"10.0.0.0/8", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatalf("parseCIDRs: %v", err)
+	}
+	if len(nets) != 2 {
+		t.Fatalf("got %d nets, want 2", len(nets))
+	}
+
+	if _, err := parseCIDRs([]string{"not-a-cidr"}); err == nil {
+		t.Error("expected an error for an invalid CIDR")
+	}
+}
+
+func TestResolveForACLLiteralIP(t *testing.T) {
+	ips := resolveForACL("1.2.3.4")
+	if ips != nil {
+		t.Errorf("resolveForACL on a literal IP should return nil (caller already has it), got %v", ips)
+	}
+}
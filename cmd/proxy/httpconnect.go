@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// httpConnectHandler returns a handler implementing a minimal HTTP CONNECT
+// proxy: it dials the requested host:port via dial and splices the two
+// connections together, mirroring serveSOCKS5's CONNECT-only behaviour for
+// clients that speak HTTP proxying instead of SOCKS5.
+func httpConnectHandler(dial dialFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveHTTPConnect(w, r, dial)
+	}
+}
+
+func serveHTTPConnect(w http.ResponseWriter, r *http.Request, dial dialFunc) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "this proxy only supports CONNECT", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dst, err := dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer dst.Close()
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client, _, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(dst, client); done <- struct{}{} }() //nolint:errcheck
+	go func() { io.Copy(client, dst); done <- struct{}{} }() //nolint:errcheck
+	<-done
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// initLogging installs a JSON slog handler as the default logger, used by
+// main and serveSOCKS5 for both lifecycle messages and per-session records.
+func initLogging() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+}
+
+// fatalf logs msg at error level and exits the process, replacing
+// log.Fatalf now that lifecycle logging goes through slog.
+func fatalf(format string, args ...any) {
+	slog.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
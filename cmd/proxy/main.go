@@ -5,23 +5,39 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"tailscale.com/net/proxymux"
 	"tailscale.com/tsnet"
 )
 
+// dialFunc dials a target, matching the signature of tsnet.Server.Dial and
+// net.Dialer.DialContext so the same value can be used for either.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
 func main() {
 	var (
-		socksPort = flag.String("port", "1080", "SOCKS5 listen port")
-		duration  = flag.Duration("duration", 4*time.Hour, "How long to run before exiting (e.g. 4h, 30m)")
-		hostname  = flag.String("hostname", "socktails", "Tailscale node hostname")
+		socksPort  = flag.String("port", "1080", "SOCKS5 listen port")
+		duration   = flag.Duration("duration", 4*time.Hour, "How long to run before exiting (e.g. 4h, 30m)")
+		hostname   = flag.String("hostname", "socktails", "Tailscale node hostname")
+		usersFile  = flag.String("users-file", "", "Path to a JSON file of SOCKS5 users (enables username/password auth and per-user access control)")
+		mux        = flag.Bool("mux", false, "Serve SOCKS5 and HTTP CONNECT on the same -port, split via proxymux; ignored when SOCKS5 username/password auth is configured")
+		httpPort   = flag.String("http-connect-port", "", "Separate port for an HTTP CONNECT proxy listener (empty disables it)")
+		mode       = flag.String("mode", "egress", `Proxy direction: "egress" (listen on the tailnet, dial out via the container network) or "ingress" (listen on the container's local network, dial out via the tailnet)`)
+		adminAddr  = flag.String("admin-addr", "", "Tailnet address (e.g. :6060) to serve /metrics and /debug/pprof on; empty disables the admin server")
+		stateDir   = flag.String("state-dir", "", "Directory to persist Tailscale node state in, so cold starts reuse the node instead of re-authenticating; empty keeps the node ephemeral")
+		allowUsers = flag.String("allow-users", "", "Comma-separated allow-list of tailnet logins (e.g. alice@example.com) permitted to use this proxy; if both this and -allow-tags are empty, all tailnet peers are allowed")
+		allowTags  = flag.String("allow-tags", "", "Comma-separated allow-list of node tags (e.g. tag:dev) permitted to use this proxy; if both this and -allow-users are empty, all tailnet peers are allowed")
 	)
 	flag.Parse()
+	initLogging()
 
 	// Environment variables override flags.
 	if v := os.Getenv("SOCKS_PORT"); v != "" {
@@ -30,17 +46,46 @@ func main() {
 	if v := os.Getenv("DURATION"); v != "" {
 		d, err := time.ParseDuration(v)
 		if err != nil {
-			log.Fatalf("invalid DURATION %q: %v", v, err)
+			fatalf("invalid DURATION %q: %v", v, err)
 		}
 		*duration = d
 	}
 	if v := os.Getenv("TS_HOSTNAME"); v != "" {
 		*hostname = v
 	}
+	if v := os.Getenv("SOCKS_USERS_FILE"); v != "" {
+		*usersFile = v
+	}
+	if v := os.Getenv("TS_STATE_DIR"); v != "" {
+		*stateDir = v
+	}
+	if *mode != "egress" && *mode != "ingress" {
+		fatalf("invalid -mode %q: want \"egress\" or \"ingress\"", *mode)
+	}
+
+	// Load the SOCKS5 user store, if configured. A non-empty store switches
+	// the greeting from "no auth" to username/password (RFC 1929).
+	var users UserStore
+	switch {
+	case *usersFile != "":
+		var err error
+		users, err = loadUsersFile(*usersFile)
+		if err != nil {
+			fatalf("loading users file: %v", err)
+		}
+		slog.Info("loaded SOCKS5 users", "count", len(users), "source", *usersFile)
+	case os.Getenv("SOCKS_USERS") != "":
+		var err error
+		users, err = parseUsersEnv(os.Getenv("SOCKS_USERS"))
+		if err != nil {
+			fatalf("parsing SOCKS_USERS: %v", err)
+		}
+		slog.Info("loaded SOCKS5 users", "count", len(users), "source", "SOCKS_USERS")
+	}
 
 	authKey := os.Getenv("TAILSCALE_AUTHKEY")
 	if authKey == "" {
-		log.Fatal("TAILSCALE_AUTHKEY environment variable is required")
+		fatalf("TAILSCALE_AUTHKEY environment variable is required")
 	}
 
 	// Root context: cancelled after duration or on signal.
@@ -52,40 +97,44 @@ func main() {
 	go func() {
 		select {
 		case sig := <-sigCh:
-			log.Printf("Received signal %v, shutting down", sig)
+			slog.Info("received signal, shutting down", "signal", sig)
 			cancel()
 		case <-ctx.Done():
 		}
 	}()
 
-	// Start embedded Tailscale (userspace networking, ephemeral node).
+	// Start embedded Tailscale (userspace networking). Ephemeral unless a
+	// persistent state store is configured below, so by default cold
+	// starts re-auth and rejoin the tailnet as a fresh node.
 	ts := &tsnet.Server{
 		Hostname:  *hostname,
 		AuthKey:   authKey,
 		Ephemeral: true,
-		// Dir is intentionally empty: tsnet will use a temporary directory.
+	}
+	if err := configureStateStore(ts, *stateDir, os.Getenv("TS_STATE")); err != nil {
+		fatalf("configuring Tailscale state store: %v", err)
 	}
 	defer ts.Close()
 
-	log.Println("Starting Tailscale (userspace mode)...")
+	slog.Info("starting Tailscale (userspace mode)")
 	if err := ts.Start(); err != nil {
-		log.Fatalf("tsnet start: %v", err)
+		fatalf("tsnet start: %v", err)
 	}
 
 	// Wait until the node is fully online in the tailnet.
 	lc, err := ts.LocalClient()
 	if err != nil {
-		log.Fatalf("getting local client: %v", err)
+		fatalf("getting local client: %v", err)
 	}
 
-	log.Println("Waiting for Tailscale to come online...")
+	slog.Info("waiting for Tailscale to come online")
 	for {
 		if ctx.Err() != nil {
-			log.Fatalf("context cancelled while waiting for Tailscale: %v", ctx.Err())
+			fatalf("context cancelled while waiting for Tailscale: %v", ctx.Err())
 		}
 		st, err := lc.Status(ctx)
 		if err != nil {
-			log.Printf("status error (retrying): %v", err)
+			slog.Info("status error, retrying", "error", err)
 			time.Sleep(500 * time.Millisecond)
 			continue
 		}
@@ -94,44 +143,183 @@ func main() {
 			for _, ip := range st.TailscaleIPs {
 				ips = append(ips, ip.String())
 			}
-			log.Printf("Tailscale online — node IPs: %v", ips)
+			slog.Info("Tailscale online", "ips", ips)
 			break
 		}
 		time.Sleep(500 * time.Millisecond)
 	}
 
-	// Listen for SOCKS5 connections on the Tailscale virtual interface.
-	ln, err := ts.Listen("tcp", ":"+*socksPort)
+	// listenFor binds socksPort/httpPort per -mode: egress listens on the
+	// tailnet (as before) and dials out locally; ingress listens on the
+	// container's local network and dials out through the tailnet.
+	listenFor := func(port string) (net.Listener, error) {
+		if *mode == "ingress" {
+			return net.Listen("tcp", "0.0.0.0:"+port)
+		}
+		return ts.Listen("tcp", ":"+port)
+	}
+
+	var dial dialFunc
+	if *mode == "ingress" {
+		dial = ts.Dial
+	} else {
+		dialer := &net.Dialer{Timeout: 15 * time.Second}
+		dial = dialer.DialContext
+	}
+
+	// Listen for SOCKS5 connections.
+	ln, err := listenFor(*socksPort)
 	if err != nil {
-		log.Fatalf("listen on :%s: %v", *socksPort, err)
+		fatalf("listen on :%s: %v", *socksPort, err)
 	}
 	defer ln.Close()
 
-	log.Printf("SOCKS5 proxy listening on Tailscale interface port %s (duration: %s)", *socksPort, *duration)
+	slog.Info("SOCKS5 proxy listening", "mode", *mode, "port", *socksPort, "duration", duration.String())
 
-	// Close the listener when the context expires so Accept unblocks.
+	acl := newPeerACL(*allowUsers, *allowTags)
+	// WhoIs only resolves identities for connections that actually arrived
+	// over the tailnet, so the allow-list is only enforced in egress mode.
+	if acl.enabled() && *mode == "ingress" {
+		slog.Warn("-allow-users/-allow-tags has no effect in ingress mode: accepted connections are local, non-tailnet callers that WhoIs can't identify", "mode", *mode)
+	}
+	applyACL := func(ln net.Listener) net.Listener {
+		return authorizingListener{Listener: ln, ctx: ctx, lc: lc, acl: acl, active: *mode == "egress"}
+	}
+
+	var socksLn net.Listener = applyACL(countingListener{ln})
+	var httpLn net.Listener
+	if !useLegacySOCKS5(users) && *mux {
+		var rawSocksLn net.Listener
+		rawSocksLn, httpLn = proxymux.SplitSOCKSAndHTTP(ln)
+		socksLn = applyACL(countingListener{rawSocksLn})
+		httpLn = applyACL(countingListener{httpLn})
+		slog.Info("sharing port between SOCKS5 and HTTP CONNECT via proxymux", "port", *socksPort)
+	}
+	dial = instrumentedDial(dial)
+
+	// Close the listener(s) when the context expires so Accept unblocks.
 	go func() {
 		<-ctx.Done()
 		ln.Close()
+		if httpLn != nil {
+			httpLn.Close()
+		}
 	}()
 
-	for {
-		conn, err := ln.Accept()
+	if httpLn != nil {
+		go http.Serve(httpLn, httpConnectHandler(dial)) //nolint:errcheck
+	}
+
+	if *httpPort != "" {
+		if useLegacySOCKS5(users) {
+			// httpConnectHandler has no notion of UserStore, so a dedicated
+			// HTTP CONNECT listener would relay any destination with none of
+			// the username/password auth or per-user ACLs users configures;
+			// refuse to start it rather than silently bypass that.
+			fatalf("-http-connect-port is not supported together with SOCKS5 username/password auth (-users-file/SOCKS_USERS); the HTTP CONNECT listener has no per-user auth or ACL enforcement")
+		}
+		hln, err := listenFor(*httpPort)
 		if err != nil {
-			// Listener closed — clean shutdown.
-			return
+			fatalf("listen on :%s: %v", *httpPort, err)
 		}
-		go serveSOCKS5(conn)
+		defer hln.Close()
+		go func() {
+			<-ctx.Done()
+			hln.Close()
+		}()
+		slog.Info("HTTP CONNECT proxy listening", "mode", *mode, "port", *httpPort)
+		go http.Serve(applyACL(countingListener{hln}), httpConnectHandler(dial)) //nolint:errcheck
+	}
+
+	if *adminAddr != "" {
+		admin := http.NewServeMux()
+		admin.HandleFunc("/metrics", metricsHandler)
+		admin.HandleFunc("/debug/pprof/", pprof.Index)
+		admin.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		admin.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		admin.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		admin.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+		aln, err := ts.Listen("tcp", *adminAddr)
+		if err != nil {
+			fatalf("listen on admin addr %s: %v", *adminAddr, err)
+		}
+		defer aln.Close()
+		go func() {
+			<-ctx.Done()
+			aln.Close()
+		}()
+		slog.Info("admin server listening on Tailscale interface", "addr", *adminAddr)
+		go http.Serve(aln, admin) //nolint:errcheck
+	}
+
+	if useLegacySOCKS5(users) {
+		slog.Info("username/password auth configured: using the built-in SOCKS5 implementation")
+		for {
+			conn, err := socksLn.Accept()
+			if err != nil {
+				// Listener closed — clean shutdown.
+				return
+			}
+			go serveSOCKS5(conn, users, dial)
+		}
+	}
+
+	if err := newTSSOCKSServer(dial).Serve(sessionLoggingListener{socksLn}); err != nil && ctx.Err() == nil {
+		fatalf("socks5 server: %v", err)
 	}
 }
 
 // serveSOCKS5 implements a minimal SOCKS5 server (RFC 1928) that handles
 // CONNECT requests and pipes data between the client and the target.
-// Only "no authentication" (method 0x00) is supported.
-// Outbound connections use the container's regular (non-Tailscale) network,
-// routing traffic out through the Cloud Run region.
-func serveSOCKS5(client net.Conn) {
-	defer client.Close()
+// If users is non-empty, clients must authenticate with username/password
+// (RFC 1929, method 0x02) and are restricted to that user's allow/deny
+// lists; otherwise only "no authentication" (method 0x00) is supported.
+// Outbound connections are made with dial, which depends on -mode: the
+// container's regular network in egress mode, or the tailnet in ingress
+// mode.
+func serveSOCKS5(client net.Conn, users UserStore, dial dialFunc) {
+	start := time.Now()
+	clientAddr := client.RemoteAddr().String()
+	var identity string
+	if ic, ok := client.(identifiedConn); ok {
+		identity = ic.identity
+	}
+
+	var (
+		target      string
+		resolvedIP  string
+		replyCode   = -1
+		dialLatency time.Duration
+		bytesUp     int64
+		bytesDown   int64
+	)
+	defer func() {
+		client.Close()
+		if target == "" {
+			return // never got far enough to parse a request; nothing worth a session record
+		}
+		attrs := []any{
+			"client", clientAddr,
+			"target", target,
+			"bytes_up", bytesUp,
+			"bytes_down", bytesDown,
+			"duration_ms", time.Since(start).Milliseconds(),
+		}
+		if identity != "" {
+			attrs = append(attrs, "identity", identity)
+		}
+		if resolvedIP != "" {
+			attrs = append(attrs, "resolved_ip", resolvedIP)
+		}
+		if dialLatency > 0 {
+			attrs = append(attrs, "dial_latency_ms", dialLatency.Milliseconds())
+		}
+		if replyCode >= 0 {
+			attrs = append(attrs, "reply_code", replyCode)
+		}
+		slog.Info("socks_session", attrs...)
+	}()
 
 	buf := make([]byte, 256)
 
@@ -152,9 +340,27 @@ func serveSOCKS5(client net.Conn) {
 		}
 	}
 
-	// Respond: version 5, no authentication required.
-	if _, err := client.Write([]byte{5, 0}); err != nil {
-		return
+	var authedUser *User
+	if len(users) > 0 {
+		if !containsMethod(buf[:nMethods], 2) {
+			client.Write([]byte{5, 0xFF}) //nolint:errcheck
+			proxyMetrics.rejected.Add(1)
+			return
+		}
+		if _, err := client.Write([]byte{5, 2}); err != nil {
+			return
+		}
+		u, ok := negotiateUserPass(client, buf, users)
+		if !ok {
+			proxyMetrics.rejected.Add(1)
+			return
+		}
+		authedUser = u
+	} else {
+		// Respond: version 5, no authentication required.
+		if _, err := client.Write([]byte{5, 0}); err != nil {
+			return
+		}
 	}
 
 	// ── Request ───────────────────────────────────────────────────────────
@@ -202,31 +408,70 @@ func serveSOCKS5(client net.Conn) {
 		return
 	}
 	port := int(buf[0])<<8 | int(buf[1])
-	target := net.JoinHostPort(addr, fmt.Sprintf("%d", port))
+	target = net.JoinHostPort(addr, fmt.Sprintf("%d", port))
+
+	if authedUser != nil {
+		var resolvedIPs []net.IP
+		if authedUser.hasCIDRRules() {
+			resolvedIPs = resolveForACL(addr)
+		}
+		if !authedUser.Authorized(addr, resolvedIPs) {
+			slog.Info("user denied access", "user", authedUser.Username, "target", target)
+			proxyMetrics.rejected.Add(1)
+			replyCode = 2
+			writeSOCKS5Error(client, 2) // connection not allowed by ruleset
+			return
+		}
+	}
 
 	// ── Connect to target ─────────────────────────────────────────────────
-	dialer := &net.Dialer{Timeout: 15 * time.Second}
-	dst, err := dialer.Dial("tcp", target)
+	dialStart := time.Now()
+	dst, err := dial(context.Background(), "tcp", target)
+	dialLatency = time.Since(dialStart)
 	if err != nil {
-		log.Printf("dial %s: %v", target, err)
+		slog.Info("dial failed", "target", target, "error", err)
+		replyCode = 4
 		writeSOCKS5Error(client, 4) // host unreachable
 		return
 	}
 	defer dst.Close()
+	if tcpAddr, ok := dst.RemoteAddr().(*net.TCPAddr); ok {
+		resolvedIP = tcpAddr.IP.String()
+	}
 
 	// ── Success reply ─────────────────────────────────────────────────────
 	// VER=5, REP=0 (success), RSV=0, ATYP=1 (IPv4), BND.ADDR=0.0.0.0, BND.PORT=0
 	if _, err := client.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
 		return
 	}
+	replyCode = 0
 
 	// ── Pipe ──────────────────────────────────────────────────────────────
+	// Each goroutine half-closes the *other* connection's write side once
+	// its copy ends, so the peer sees EOF promptly instead of the other
+	// copy blocking until the deferred Close above runs. We wait for both
+	// done signals before that deferred Close (and before the bytesUp/
+	// bytesDown read above) fires, otherwise the still-running copy and
+	// the session logger race on the same variables.
 	done := make(chan struct{}, 2)
-	go func() { io.Copy(dst, client); done <- struct{}{} }()   //nolint:errcheck
-	go func() { io.Copy(client, dst); done <- struct{}{} }()   //nolint:errcheck
+	go func() { bytesUp, _ = io.Copy(dst, client); closeWrite(dst); done <- struct{}{} }()
+	go func() { bytesDown, _ = io.Copy(client, dst); closeWrite(client); done <- struct{}{} }()
+	<-done
 	<-done
 }
 
+// closeWrite half-closes conn's write side if it supports it (as
+// *net.TCPConn and tsnet connections do), so the peer observes EOF without
+// waiting for the whole connection to close.
+func closeWrite(conn net.Conn) {
+	if ic, ok := conn.(identifiedConn); ok {
+		conn = ic.Conn
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite() //nolint:errcheck
+	}
+}
+
 // writeSOCKS5Error sends a SOCKS5 error reply with the given REP code.
 func writeSOCKS5Error(w io.Writer, rep byte) {
 	w.Write([]byte{5, rep, 0, 1, 0, 0, 0, 0, 0, 0}) //nolint:errcheck
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// proxyMetrics holds process-wide counters and a dial-latency histogram for
+// both the legacy serveSOCKS5 path and tailscale.com/net/socks5, since both
+// share the same dial func and listener. Exposed by metricsHandler in
+// Prometheus text exposition format.
+var proxyMetrics = struct {
+	accepted atomic.Uint64
+	rejected atomic.Uint64
+	failed   atomic.Uint64
+
+	dialLatency *latencyHistogram
+}{
+	dialLatency: newLatencyHistogram([]time.Duration{
+		10 * time.Millisecond,
+		50 * time.Millisecond,
+		100 * time.Millisecond,
+		250 * time.Millisecond,
+		500 * time.Millisecond,
+		time.Second,
+		5 * time.Second,
+		15 * time.Second,
+	}),
+}
+
+// latencyHistogram is a fixed-bucket histogram with Prometheus
+// histogram_bucket semantics: counts[i] tallies every observation <=
+// buckets[i].
+type latencyHistogram struct {
+	mu      sync.Mutex
+	buckets []time.Duration
+	counts  []uint64
+	sum     time.Duration
+	total   uint64
+}
+
+func newLatencyHistogram(buckets []time.Duration) *latencyHistogram {
+	return &latencyHistogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sum += d
+	h.total++
+	for i, b := range h.buckets {
+		if d <= b {
+			h.counts[i]++
+		}
+	}
+}
+
+func (h *latencyHistogram) writeProm(w http.ResponseWriter, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s Dial latency in seconds.\n", name)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, b.Seconds(), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.total)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum.Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, h.total)
+}
+
+// metricsHandler serves proxyMetrics in Prometheus text exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeCounter(w, "socktails_connections_accepted_total", "Accepted proxy connections.", proxyMetrics.accepted.Load())
+	writeCounter(w, "socktails_connections_rejected_total", "Connections rejected by auth or ACL.", proxyMetrics.rejected.Load())
+	writeCounter(w, "socktails_connections_failed_total", "Connections that failed to dial their target.", proxyMetrics.failed.Load())
+
+	proxyMetrics.dialLatency.writeProm(w, "socktails_dial_latency_seconds")
+}
+
+func writeCounter(w http.ResponseWriter, name, help string, v uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	fmt.Fprintf(w, "%s %d\n", name, v)
+}
+
+// countingListener wraps a net.Listener and counts each accepted connection
+// toward proxyMetrics.accepted.
+type countingListener struct {
+	net.Listener
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		proxyMetrics.accepted.Add(1)
+	}
+	return conn, err
+}
+
+// instrumentedDial wraps dial so every call records its latency in
+// proxyMetrics.dialLatency and counts failures toward proxyMetrics.failed.
+func instrumentedDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(ctx, network, addr)
+		proxyMetrics.dialLatency.observe(time.Since(start))
+		if err != nil {
+			proxyMetrics.failed.Add(1)
+		}
+		return conn, err
+	}
+}
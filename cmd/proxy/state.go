@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"tailscale.com/ipn/store"
+	_ "tailscale.com/ipn/store/awsstore"
+	_ "tailscale.com/ipn/store/kubestore"
+	"tailscale.com/tsnet"
+)
+
+// configureStateStore wires a persistent ipn.StateStore into ts so the node
+// identity survives restarts, instead of the default ephemeral, in-memory
+// node. tsState takes priority: it's passed straight to
+// tailscale.com/ipn/store.New, which understands "kube:secret-name" (via
+// the blank-imported kubestore) and "arn:...secret-arn" (via awsstore) in
+// addition to a plain directory path, the same set tailscaled's -state
+// flag accepts. stateDir is the simple case: a local directory, set via
+// -state-dir/TS_STATE_DIR.
+//
+// Neither is required: if both are empty, ts keeps its default Ephemeral
+// (no persistence) behaviour.
+func configureStateStore(ts *tsnet.Server, stateDir, tsState string) error {
+	switch {
+	case tsState != "":
+		if err := checkStateStoreScheme(tsState); err != nil {
+			return err
+		}
+		logf := func(format string, args ...any) { slog.Info(fmt.Sprintf(format, args...)) }
+		st, err := store.New(logf, tsState)
+		if err != nil {
+			return fmt.Errorf("opening state store %q: %w", tsState, err)
+		}
+		ts.Store = st
+		ts.Ephemeral = false
+	case stateDir != "":
+		ts.Dir = stateDir
+		ts.Ephemeral = false
+	}
+	return nil
+}
+
+// checkStateStoreScheme rejects a TS_STATE value that looks like a
+// non-filesystem backend reference but isn't one of the schemes this
+// binary actually registers (kube:, arn:, or store.New's built-in mem:).
+// Without this, store.New falls through to NewFileStore for anything it
+// doesn't recognize and silently writes state to a literal file named
+// after the whole string -- e.g. a typo'd scheme or one this package
+// doesn't implement (there is no "gcs://" backend in
+// tailscale.com/ipn/store) would look configured but still lose state on
+// every restart.
+func checkStateStoreScheme(tsState string) error {
+	for _, prefix := range []string{"kube:", "arn:", "mem:"} {
+		if strings.HasPrefix(tsState, prefix) {
+			return nil
+		}
+	}
+	if strings.Contains(tsState, "://") {
+		return fmt.Errorf("unsupported TS_STATE %q: tailscale.com/ipn/store only supports \"kube:<secret-name>\" and \"arn:<secret-arn>\" (AWS) non-filesystem backends, or a local directory path", tsState)
+	}
+	return nil
+}